@@ -0,0 +1,214 @@
+package shmx
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// AuthNone requires nothing of a frame: today's wire format.
+	AuthNone = 0
+	// AuthPSK authenticates every frame with a ChaCha20-Poly1305 tag
+	// keyed by AttachOptions.Key.
+	AuthPSK = 1
+)
+
+const (
+	// EncNone leaves frame payloads in plain text.
+	EncNone = 0
+	// EncChaCha20Poly1305 additionally AEAD-encrypts every frame payload
+	// in place. Requires AuthMode != AuthNone.
+	EncChaCha20Poly1305 = 1
+)
+
+// authTagSize is the width of a ChaCha20-Poly1305 tag on the wire.
+const authTagSize = 16
+
+// authHeaderExtra is how much longer a frame header is, past
+// pHeaderSize, once AuthMode != AuthNone: an 8-byte wire nonce and a
+// 16-byte auth tag.
+const authHeaderExtra = 8 + authTagSize
+
+// AttachOptions configures per-frame authentication and, optionally,
+// encryption for AttachWithOptions. Attach and AttachN use the zero
+// value: AuthNone, EncNone, today's 12-byte header, unchanged.
+type AttachOptions struct {
+	// AuthMode selects how a frame must prove it came from a holder of
+	// Key. AuthPSK tags every frame with ChaCha20-Poly1305.
+	AuthMode byte
+
+	// EncMode selects whether payloads are also AEAD-encrypted in place.
+	// EncChaCha20Poly1305 requires AuthMode == AuthPSK.
+	EncMode byte
+
+	// Key is the pre-shared ChaCha20-Poly1305 key. Required, and must be
+	// chacha20poly1305.KeySize bytes, when AuthMode != AuthNone.
+	Key []byte
+}
+
+// validate rejects a misconfigured AttachOptions before it reaches the
+// Master/Slave handshake.
+func (o AttachOptions) validate() error {
+	switch o.AuthMode {
+	case AuthNone, AuthPSK:
+	default:
+		return fmt.Errorf("shmx: invalid AuthMode %d", o.AuthMode)
+	}
+
+	switch o.EncMode {
+	case EncNone, EncChaCha20Poly1305:
+	default:
+		return fmt.Errorf("shmx: invalid EncMode %d", o.EncMode)
+	}
+
+	if o.EncMode != EncNone && o.AuthMode == AuthNone {
+		return fmt.Errorf("shmx: EncMode %d requires AuthMode != AuthNone", o.EncMode)
+	}
+
+	if o.AuthMode != AuthNone && len(o.Key) != chacha20poly1305.KeySize {
+		return fmt.Errorf("shmx: Key must be %d bytes, got %d", chacha20poly1305.KeySize, len(o.Key))
+	}
+
+	return nil
+}
+
+// GenerateKey returns a new random pre-shared key of the right size for
+// AttachOptions.Key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("shmx: GenerateKey: %v", err)
+	}
+	return key, nil
+}
+
+// newAEAD builds the keyed cipher for opts, or nil if opts negotiates no
+// authentication at all.
+func newAEAD(opts AttachOptions) (cipher.AEAD, error) {
+	if opts.AuthMode == AuthNone {
+		return nil, nil
+	}
+	aead, err := chacha20poly1305.New(opts.Key)
+	if err != nil {
+		return nil, fmt.Errorf("shmx: chacha20poly1305.New: %v", err)
+	}
+	return aead, nil
+}
+
+// frameHeaderSize is the on-wire size of a frame header: pHeaderSize,
+// plus a nonce and auth tag once this attach has negotiated AuthMode !=
+// AuthNone. AuthMode==0, EncMode==0 keeps today's 12-byte header intact.
+func (sm *Shmx) frameHeaderSize() uint32 {
+	if sm.authMode == AuthNone {
+		return pHeaderSize
+	}
+	return pHeaderSize + authHeaderExtra
+}
+
+// encodeFullHeader appends the wire nonce and auth tag to ad when authMode
+// requires them, for the wrap-straddling ReserveN/WriteN path.
+func (sm *Shmx) encodeFullHeader(ad []byte, nonce uint64, tag [authTagSize]byte) []byte {
+	if sm.authMode == AuthNone {
+		return ad
+	}
+	hdr := make([]byte, 0, len(ad)+authHeaderExtra)
+	hdr = append(hdr, ad...)
+	var nb [8]byte
+	binary.LittleEndian.PutUint64(nb[:], nonce)
+	hdr = append(hdr, nb[:]...)
+	hdr = append(hdr, tag[:]...)
+	return hdr
+}
+
+// pairBase is the absolute file offset of the "A" ring of the ring pair
+// held at sm.pairs[i], the same value whether this Shmx is the Master or
+// the Slave (whose sm.pairs holds only the pair it claimed).
+func (sm *Shmx) pairBase(i int) uint32 {
+	pairSize := sm.configRingStride * 2
+	rel := sm.pairs[i].rxCbOffset - sm.configRingOffset
+	return sm.configRingOffset + rel/pairSize*pairSize
+}
+
+// txSelector and rxSelector report which physical ring ("A" or "B") of
+// pair i this Shmx's tx/rx side maps to, so buildNonce's selector byte
+// agrees between writer and reader without spending any wire bytes on it.
+func (sm *Shmx) txSelector(i int) byte {
+	if sm.pairs[i].txCbOffset == sm.pairBase(i) {
+		return 0
+	}
+	return 1
+}
+
+func (sm *Shmx) rxSelector(i int) byte {
+	if sm.pairs[i].rxCbOffset == sm.pairBase(i) {
+		return 0
+	}
+	return 1
+}
+
+// buildNonce derives the 12-byte ChaCha20-Poly1305 nonce from the wire
+// nonce counter and the physical ring, so the two directions of a pair
+// never reuse a (key, nonce) pair despite sharing one pre-shared key.
+func buildNonce(selector byte, wireNonce uint64) [chacha20poly1305.NonceSize]byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(n[:8], wireNonce)
+	n[8] = selector
+	return n
+}
+
+// sealFrame advances ring pair i's tx nonce and AEAD-seals an
+// about-to-be-written frame, returning the wire nonce and auth tag. When
+// EncMode is EncNone, buf is folded into the associated data instead of
+// being encrypted; otherwise buf is overwritten with ciphertext in place.
+func (sm *Shmx) sealFrame(i int, ad []byte, buf []byte) (nonce uint64, tag [authTagSize]byte) {
+	pr := &sm.pairs[i]
+	pr.txNonce++
+	nonce = pr.txNonce
+	nb := buildNonce(sm.txSelector(i), nonce)
+
+	var sealed []byte
+	if sm.encMode == EncNone {
+		full := make([]byte, 0, len(ad)+len(buf))
+		full = append(full, ad...)
+		full = append(full, buf...)
+		sealed = sm.aead.Seal(nil, nb[:], nil, full)
+	} else {
+		sealed = sm.aead.Seal(nil, nb[:], buf, ad)
+		copy(buf, sealed[:len(buf)])
+	}
+	copy(tag[:], sealed[len(sealed)-authTagSize:])
+	return nonce, tag
+}
+
+// verifyFrame authenticates a received frame without decrypting anything,
+// for EncMode == EncNone. Unlike openFrame, it never allocates a
+// replacement for head/tail, keeping the caller's zero-copy mmap slices.
+func (sm *Shmx) verifyFrame(i int, ad []byte, head, tail []byte, wireNonce uint64, tag [authTagSize]byte) bool {
+	nb := buildNonce(sm.rxSelector(i), wireNonce)
+	full := make([]byte, 0, len(ad)+len(head)+len(tail))
+	full = append(full, ad...)
+	full = append(full, head...)
+	full = append(full, tail...)
+	_, err := sm.aead.Open(nil, nb[:], tag[:], full)
+	return err == nil
+}
+
+// openFrame verifies and decrypts a received frame for EncMode !=
+// EncNone. ok is false on any authentication failure, in which case the
+// caller must drop the frame rather than trust plain.
+func (sm *Shmx) openFrame(i int, ad []byte, payload []byte, wireNonce uint64, tag [authTagSize]byte) (plain []byte, ok bool) {
+	nb := buildNonce(sm.rxSelector(i), wireNonce)
+
+	ct := make([]byte, 0, len(payload)+authTagSize)
+	ct = append(ct, payload...)
+	ct = append(ct, tag[:]...)
+	plain, err := sm.aead.Open(nil, nb[:], ct, ad)
+	if err != nil {
+		return nil, false
+	}
+	return plain, true
+}
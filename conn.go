@@ -0,0 +1,155 @@
+package shmx
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Addr identifies one end of a shmx connection by the backing mmap file
+// and the role (Master or Slave) that end plays.
+type Addr struct {
+	Path string
+	Role Control
+}
+
+// Network implements net.Addr.
+func (a Addr) Network() string { return "shmx" }
+
+// String implements net.Addr.
+func (a Addr) String() string {
+	role := "master"
+	if a.Role == Slave {
+		role = "slave"
+	}
+	return fmt.Sprintf("shmx:%s:%s", role, a.Path)
+}
+
+// Conn adapts a Shmx into a net.Conn, so it drops into existing networking
+// code (http.Server, grpc.Server via grpc.NewServer().Serve, yamux, ...)
+// without writing any glue. Use Dial or a Listener's Accept to obtain one;
+// both put the underlying Shmx into blocking mode so Read/Write behave
+// like a normal net.Conn instead of shmx's default poll-and-return.
+type Conn struct {
+	sm *Shmx
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) { return c.sm.Read(b) }
+
+// Write implements net.Conn.
+func (c *Conn) Write(b []byte) (int, error) { return c.sm.Write(b) }
+
+// Close implements net.Conn. It closes the underlying Shmx first, waking
+// any Read/Write currently blocked in another goroutine with io.EOF, and
+// only then detaches (unmaps) it: unmapping out from under a goroutine
+// still inside FUTEX_WAIT on that mapping is unsafe.
+func (c *Conn) Close() error {
+	c.sm.Close()
+	c.sm.Detach()
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	return Addr{Path: c.sm.path, Role: c.sm.role}
+}
+
+// RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	peer := Slave
+	if c.sm.role == Slave {
+		peer = Master
+	}
+	return Addr{Path: c.sm.path, Role: peer}
+}
+
+// SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error { return c.sm.SetDeadline(t) }
+
+// SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.sm.SetReadDeadline(t) }
+
+// SetWriteDeadline implements net.Conn.
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.sm.SetWriteDeadline(t) }
+
+// Dial attaches to path as a Slave and returns it as a net.Conn talking to
+// whichever process called Listen (or Attach(Master, ...)) on that path.
+func Dial(path string) (net.Conn, error) {
+	sm := new(Shmx)
+	if err := sm.Attach(Slave, path); err != nil {
+		return nil, err
+	}
+	if err := sm.SetDeadline(time.Time{}); err != nil {
+		sm.Detach()
+		return nil, err
+	}
+	return &Conn{sm: sm}, nil
+}
+
+// listener implements net.Listener over a single shmx Master ring pair.
+// Unlike a socket listener, shmx has no backlog: Accept blocks until the
+// one Slave that will ever use this path has attached and claimed the
+// pair and returns the Conn for it; every subsequent Accept call blocks
+// until Close and then fails.
+type listener struct {
+	sm       *Shmx
+	accepted int32
+	closed   int32
+}
+
+// Listen creates path as a Master and returns a net.Listener whose Accept
+// waits for a Slave to complete attachment: the shmxFlagInit handshake
+// plus the slave-written ring-pair "owner" claim from Attach. It serves
+// exactly one connection; see listener.
+func Listen(path string) (net.Listener, error) {
+	sm := new(Shmx)
+	if err := sm.Attach(Master, path); err != nil {
+		return nil, err
+	}
+	return &listener{sm: sm}, nil
+}
+
+// Accept implements net.Listener.
+func (l *listener) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(&l.accepted, 0, 1) {
+		ownerAddr := l.sm.u32Addr(l.sm.pairOwnerOffset(0))
+		for atomic.LoadUint32(ownerAddr) == 0 {
+			if atomic.LoadInt32(&l.closed) != 0 {
+				l.sm.Detach()
+				return nil, fmt.Errorf("shmx: listener %s closed", l.sm.path)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := l.sm.SetDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		return &Conn{sm: l.sm}, nil
+	}
+
+	// shmx serves a single connection per Listen; like any net.Listener
+	// with no pending connection, further Accept calls simply block until
+	// Close, rather than erroring out from under a Serve loop that keeps
+	// calling Accept once the one connection has been handed off.
+	for atomic.LoadInt32(&l.closed) == 0 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("shmx: listener %s closed", l.sm.path)
+}
+
+// Close implements net.Listener, unblocking a pending Accept and
+// detaching the underlying Shmx if no Slave ever attached.
+func (l *listener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	if atomic.CompareAndSwapInt32(&l.accepted, 0, 1) {
+		l.sm.Detach()
+	}
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *listener) Addr() net.Addr {
+	return Addr{Path: l.sm.path, Role: Master}
+}
@@ -0,0 +1,37 @@
+// Command client demonstrates talking HTTP to the server example over a
+// shmx connection, with no sockets involved.
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"shmx"
+)
+
+func main() {
+	conn, err := shmx.Dial("/tmp/shmx-http.nic")
+	if err != nil {
+		log.Fatalf("shmx.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://shmx/", nil)
+	if err != nil {
+		log.Fatalf("http.NewRequest: %v", err)
+	}
+	if err := req.Write(conn); err != nil {
+		log.Fatalf("req.Write: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		log.Fatalf("http.ReadResponse: %v", err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+}
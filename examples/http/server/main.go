@@ -0,0 +1,28 @@
+// Command server demonstrates serving HTTP over a shmx connection instead
+// of a TCP socket. Run it, then run the client example against the same
+// path to fetch a page over shared memory.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"shmx"
+)
+
+func main() {
+	lis, err := shmx.Listen("/tmp/shmx-http.nic")
+	if err != nil {
+		log.Fatalf("shmx.Listen: %v", err)
+	}
+	defer lis.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "hello over shmx")
+	})
+
+	log.Println("waiting for the client to attach...")
+	log.Fatal(http.Serve(lis, mux))
+}
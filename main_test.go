@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"shmx"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHandler(t *testing.T) {
@@ -62,6 +66,322 @@ func TestHandler(t *testing.T) {
 	fmt.Println("master WPktLost", mStats.WPktLost)
 }
 
+func TestMultiRingPairFanout(t *testing.T) {
+
+	const ringPairs = 3
+	const ringSize = 1024 * 1024
+
+	path := "shmx-fanout.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	err := master.AttachN(shmx.Master, path, ringPairs, ringSize)
+	if err != nil {
+		t.Fatalf("master.AttachN failed %v", err)
+	}
+	defer master.Detach()
+
+	slaves := make([]*shmx.Shmx, ringPairs)
+	for i := range slaves {
+		slaves[i] = new(shmx.Shmx)
+		err = slaves[i].Attach(shmx.Slave, path)
+		if err != nil {
+			t.Fatalf("slave[%d].Attach failed %v", i, err)
+		}
+		defer slaves[i].Detach()
+	}
+
+	// A further slave should find every pair already claimed.
+	extra := new(shmx.Shmx)
+	err = extra.Attach(shmx.Slave, path)
+	if err == nil {
+		t.Errorf("expected extra slave Attach to fail, all pairs claimed")
+		extra.Detach()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < ringPairs; i++ {
+		ch, err := master.Channel(i)
+		if err != nil {
+			t.Fatalf("master.Channel(%d) failed %v", i, err)
+		}
+
+		wg.Add(1)
+		go func(i int, ch interface {
+			Read([]byte) (int, error)
+			Write([]byte) (int, error)
+		}) {
+			defer wg.Done()
+
+			msg := fmt.Sprintf("hello from pair %d", i)
+
+			n, err := slaves[i].Write([]byte(msg))
+			if err != nil || n != len(msg) {
+				t.Errorf("slave[%d].Write failed n=%d err=%v", i, n, err)
+				return
+			}
+
+			b := make([]byte, shmx.ShmxMaxLen)
+			for {
+				n, err = ch.Read(b)
+				if err != nil {
+					t.Errorf("master.Channel(%d).Read failed %v", i, err)
+					return
+				}
+				if n > 0 {
+					break
+				}
+			}
+
+			if string(b[0:n]) != msg {
+				t.Errorf("pair %d: got %q want %q", i, string(b[0:n]), msg)
+			}
+		}(i, ch)
+	}
+	wg.Wait()
+}
+
+func TestBlockingReadWrite(t *testing.T) {
+
+	path := "shmx-blocking.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	err := master.Attach(shmx.Master, path)
+	if err != nil {
+		t.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	err = slave.Attach(shmx.Slave, path)
+	if err != nil {
+		t.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	if err = master.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("master.SetReadDeadline failed %v", err)
+	}
+
+	msg := "blocking read wakes on write"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(50 * time.Millisecond)
+		n, err := slave.Write([]byte(msg))
+		if err != nil || n != len(msg) {
+			t.Errorf("slave.Write failed n=%d err=%v", n, err)
+		}
+	}()
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := master.Read(b)
+	if err != nil {
+		t.Errorf("blocking master.Read failed %v", err)
+	}
+	if string(b[0:n]) != msg {
+		t.Errorf("blocking read got %q want %q", string(b[0:n]), msg)
+	}
+	<-done
+
+	if err = master.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatalf("master.SetReadDeadline failed %v", err)
+	}
+	_, err = master.Read(b)
+	if err == nil {
+		t.Errorf("expected master.Read to time out on an empty ring")
+	}
+
+	if err = master.Close(); err != nil {
+		t.Errorf("master.Close failed %v", err)
+	}
+	if err = master.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("master.SetReadDeadline failed %v", err)
+	}
+	if _, err = master.Read(b); err != io.EOF {
+		t.Errorf("expected io.EOF after Close, got %v", err)
+	}
+}
+
+// TestMasterDoesNotBlockBeforeSlaveAttaches guards against a Master
+// trusting its own shmxFlagBlocking and futex-waiting on a ring pair no
+// Slave has claimed yet: before any Slave attaches, nothing can ever
+// wake that wait, so a blocking Read must fall back to poll mode instead
+// of hanging.
+func TestMasterDoesNotBlockBeforeSlaveAttaches(t *testing.T) {
+
+	path := "shmx-blocking-no-slave.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	if err := master.Attach(shmx.Master, path); err != nil {
+		t.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	if err := master.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatalf("master.SetReadDeadline failed %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, shmx.ShmxMaxLen)
+		master.Read(b)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("master.Read blocked forever with no Slave ever attached")
+	}
+}
+
+// TestObserverSeesLiveOccupancy attaches a third process read-only while
+// a Master/Slave pair exchanges frames, confirming Observer sees live
+// gauges without claiming a pair and can't Read/Write/Reserve.
+func TestObserverSeesLiveOccupancy(t *testing.T) {
+
+	path := "shmx-observer.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	if err := master.Attach(shmx.Master, path); err != nil {
+		t.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err := slave.Attach(shmx.Slave, path); err != nil {
+		t.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	observer := new(shmx.Shmx)
+	if err := observer.Attach(shmx.Observer, path); err != nil {
+		t.Fatalf("observer.Attach failed %v", err)
+	}
+	defer observer.Detach()
+
+	if _, err := master.Write([]byte("hello")); err != nil {
+		t.Fatalf("master.Write failed %v", err)
+	}
+
+	occ, err := observer.Occupancy(0)
+	if err != nil {
+		t.Fatalf("observer.Occupancy failed %v", err)
+	}
+	if occ == 0 {
+		t.Fatal("observer.Occupancy reported 0 after master.Write")
+	}
+
+	if _, _, err := observer.Reserve(1); err == nil {
+		t.Fatal("observer.Reserve should have failed")
+	}
+	b := make([]byte, shmx.ShmxMaxLen)
+	if _, err := observer.Read(b); err == nil {
+		t.Fatal("observer.Read should have failed")
+	}
+}
+
+func TestConnListenDialRoundTrip(t *testing.T) {
+
+	path := "shmx-conn.nic"
+	os.Remove(path)
+
+	ln, err := shmx.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed %v", err)
+	}
+	defer ln.Close()
+
+	acceptErr := make(chan error, 1)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, aerr := ln.Accept()
+		accepted <- c
+		acceptErr <- aerr
+	}()
+
+	client, err := shmx.Dial(path)
+	if err != nil {
+		t.Fatalf("Dial failed %v", err)
+	}
+	defer client.Close()
+
+	if err = <-acceptErr; err != nil {
+		t.Fatalf("Accept failed %v", err)
+	}
+	server := <-accepted
+	defer server.Close()
+
+	msg := "hello over shmx.Conn"
+	if _, err = client.Write([]byte(msg)); err != nil {
+		t.Fatalf("client.Write failed %v", err)
+	}
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := server.Read(b)
+	if err != nil || string(b[:n]) != msg {
+		t.Fatalf("server.Read failed n=%d err=%v", n, err)
+	}
+}
+
+func TestConnCloseUnblocksRead(t *testing.T) {
+
+	path := "shmx-conn-close.nic"
+	os.Remove(path)
+
+	ln, err := shmx.Listen(path)
+	if err != nil {
+		t.Fatalf("Listen failed %v", err)
+	}
+	defer ln.Close()
+
+	acceptErr := make(chan error, 1)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, aerr := ln.Accept()
+		accepted <- c
+		acceptErr <- aerr
+	}()
+
+	client, err := shmx.Dial(path)
+	if err != nil {
+		t.Fatalf("Dial failed %v", err)
+	}
+	defer client.Close()
+
+	if err = <-acceptErr; err != nil {
+		t.Fatalf("Accept failed %v", err)
+	}
+	server := <-accepted
+
+	readErr := make(chan error, 1)
+	go func() {
+		b := make([]byte, shmx.ShmxMaxLen)
+		_, rerr := server.Read(b)
+		readErr <- rerr
+	}()
+
+	// Give the Read a moment to actually block in waitForData before
+	// racing Close against it.
+	time.Sleep(20 * time.Millisecond)
+	if err = server.Close(); err != nil {
+		t.Fatalf("server.Close failed %v", err)
+	}
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Errorf("server.Read returned nil error after Close, want io.EOF")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server.Read blocked on a closed Conn did not return within 2s")
+	}
+}
+
 func echoTest(t *testing.T, master *shmx.Shmx, slave *shmx.Shmx, s string) {
 	var err error
 	var n int
@@ -147,3 +467,421 @@ func readUntilEmpty(t *testing.T, sm *shmx.Shmx) {
 
 	fmt.Println("readUntilEmpty", i)
 }
+
+func TestZeroCopyReadWrite(t *testing.T) {
+
+	path := "shmx-zerocopy.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	err := master.Attach(shmx.Master, path)
+	if err != nil {
+		t.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	err = slave.Attach(shmx.Slave, path)
+	if err != nil {
+		t.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	msg := "zero-copy round trip"
+
+	buf, commit, err := master.Reserve(len(msg))
+	if err != nil {
+		t.Fatalf("master.Reserve failed %v", err)
+	}
+	copy(buf, msg)
+	commit()
+
+	head, tail, release, err := slave.NextReadFrame()
+	if err != nil {
+		t.Fatalf("slave.NextReadFrame failed %v", err)
+	}
+	got := append(append([]byte{}, head...), tail...)
+	if string(got) != msg {
+		t.Errorf("NextReadFrame got %q want %q", got, msg)
+	}
+	release()
+
+	// A frame that straddles the ring's wrap point must come back split
+	// across head and tail, and still round-trip correctly. Using a tiny
+	// ring forces a wrap within a handful of same-size frames.
+	wrapPath := "shmx-zerocopy-wrap.nic"
+	os.Remove(wrapPath)
+
+	wMaster := new(shmx.Shmx)
+	if err = wMaster.AttachN(shmx.Master, wrapPath, 1, 256); err != nil {
+		t.Fatalf("master.AttachN failed %v", err)
+	}
+	defer wMaster.Detach()
+
+	wSlave := new(shmx.Shmx)
+	if err = wSlave.Attach(shmx.Slave, wrapPath); err != nil {
+		t.Fatalf("slave.Attach failed %v", err)
+	}
+	defer wSlave.Detach()
+
+	frame := make([]byte, 50)
+	sawSplit := false
+	for i := 0; i < 20 && !sawSplit; i++ {
+		for j := range frame {
+			frame[j] = byte(i)
+		}
+
+		buf, commit, err := wMaster.Reserve(len(frame))
+		if err != nil {
+			t.Fatalf("master.Reserve failed %v", err)
+		}
+		copy(buf, frame)
+		commit()
+
+		head, tail, release, err := wSlave.NextReadFrame()
+		if err != nil {
+			t.Fatalf("slave.NextReadFrame failed %v", err)
+		}
+		got := append(append([]byte{}, head...), tail...)
+		if !bytes.Equal(got, frame) {
+			t.Fatalf("round %d: NextReadFrame got %v want %v", i, got, frame)
+		}
+		if len(tail) > 0 {
+			sawSplit = true
+		}
+		release()
+	}
+
+	if !sawSplit {
+		t.Errorf("expected at least one split frame across %d rounds", 20)
+	}
+}
+
+func TestStatsAndMetrics(t *testing.T) {
+
+	path := "shmx-stats.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	err := master.Attach(shmx.Master, path)
+	if err != nil {
+		t.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	err = slave.Attach(shmx.Slave, path)
+	if err != nil {
+		t.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	msg := "stats and metrics"
+	if _, err = master.Write([]byte(msg)); err != nil {
+		t.Fatalf("master.Write failed %v", err)
+	}
+
+	var mStats shmx.Stats
+	master.Stats(&mStats)
+	if mStats.WPktWrote != 1 {
+		t.Errorf("master WPktWrote = %d, want 1", mStats.WPktWrote)
+	}
+	if mStats.BytesWritten != uint64(len(msg)) {
+		t.Errorf("master BytesWritten = %d, want %d", mStats.BytesWritten, len(msg))
+	}
+	if mStats.HighWater == 0 {
+		t.Errorf("master HighWater = 0, want > 0")
+	}
+	if mStats.LastOpUnixNano == 0 {
+		t.Errorf("master LastOpUnixNano = 0, want nonzero")
+	}
+
+	occ, err := slave.Occupancy(0)
+	if err != nil {
+		t.Fatalf("slave.Occupancy failed %v", err)
+	}
+	if occ == 0 {
+		t.Errorf("slave.Occupancy = 0, want > 0 before the frame is read")
+	}
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := slave.Read(b)
+	if err != nil || string(b[:n]) != msg {
+		t.Fatalf("slave.Read failed n=%d err=%v", n, err)
+	}
+
+	var sStats shmx.Stats
+	slave.Stats(&sStats)
+	if sStats.RPktRead != 1 || sStats.BytesRead != uint64(len(msg)) {
+		t.Errorf("slave stats = %+v, want RPktRead=1 BytesRead=%d", sStats, len(msg))
+	}
+
+	var buf bytes.Buffer
+	if err = master.WriteMetrics(&buf); err != nil {
+		t.Fatalf("master.WriteMetrics failed %v", err)
+	}
+	out := buf.String()
+	want := fmt.Sprintf("shmx_bytes_written_total{path=\"shmx-stats.nic\",pair=\"0\"} %d", len(msg))
+	if !strings.Contains(out, want) {
+		t.Errorf("WriteMetrics output missing expected bytes-written line %q:\n%s", want, out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("WriteMetrics output missing trailing # EOF line:\n%s", out)
+	}
+}
+
+func TestAuthenticatedFrames(t *testing.T) {
+
+	path := "shmx-auth.nic"
+	os.Remove(path)
+
+	key, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+
+	master := new(shmx.Shmx)
+	opts := shmx.AttachOptions{AuthMode: shmx.AuthPSK, Key: key}
+	if err = master.AttachWithOptions(shmx.Master, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("master.AttachWithOptions failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err = slave.AttachWithOptions(shmx.Slave, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("slave.AttachWithOptions failed %v", err)
+	}
+	defer slave.Detach()
+
+	msg := "authenticated but still legible"
+	if _, err = master.Write([]byte(msg)); err != nil {
+		t.Fatalf("master.Write failed %v", err)
+	}
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := slave.Read(b)
+	if err != nil || string(b[:n]) != msg {
+		t.Fatalf("slave.Read failed n=%d err=%v", n, err)
+	}
+}
+
+// TestAuthenticatedFramesZeroCopy exercises NextReadFrame (rather than the
+// copying Read) under AuthPSK with EncNone, which must still verify and
+// hand back the mmap-backed head/tail instead of forcing a copy the way
+// an encrypted attach does.
+func TestAuthenticatedFramesZeroCopy(t *testing.T) {
+
+	path := "shmx-auth-zerocopy.nic"
+	os.Remove(path)
+
+	key, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+
+	master := new(shmx.Shmx)
+	opts := shmx.AttachOptions{AuthMode: shmx.AuthPSK, Key: key}
+	if err = master.AttachWithOptions(shmx.Master, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("master.AttachWithOptions failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err = slave.AttachWithOptions(shmx.Slave, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("slave.AttachWithOptions failed %v", err)
+	}
+	defer slave.Detach()
+
+	msg := "authenticated, unencrypted, zero-copy"
+	buf, commit, err := master.Reserve(len(msg))
+	if err != nil {
+		t.Fatalf("master.Reserve failed %v", err)
+	}
+	copy(buf, msg)
+	commit()
+
+	head, tail, release, err := slave.NextReadFrame()
+	if err != nil {
+		t.Fatalf("slave.NextReadFrame failed %v", err)
+	}
+	got := append(append([]byte{}, head...), tail...)
+	if string(got) != msg {
+		t.Errorf("NextReadFrame got %q want %q", got, msg)
+	}
+	release()
+}
+
+func TestEncryptedFrames(t *testing.T) {
+
+	path := "shmx-enc.nic"
+	os.Remove(path)
+
+	key, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+
+	opts := shmx.AttachOptions{AuthMode: shmx.AuthPSK, EncMode: shmx.EncChaCha20Poly1305, Key: key}
+
+	master := new(shmx.Shmx)
+	if err = master.AttachWithOptions(shmx.Master, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("master.AttachWithOptions failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err = slave.AttachWithOptions(shmx.Slave, path, 1, 1<<20, opts); err != nil {
+		t.Fatalf("slave.AttachWithOptions failed %v", err)
+	}
+	defer slave.Detach()
+
+	msg := "this payload must not appear in the ring as plain text"
+	if _, err = master.Write([]byte(msg)); err != nil {
+		t.Fatalf("master.Write failed %v", err)
+	}
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := slave.Read(b)
+	if err != nil || string(b[:n]) != msg {
+		t.Fatalf("slave.Read failed n=%d err=%v", n, err)
+	}
+}
+
+func TestModeMismatchFailsAttach(t *testing.T) {
+
+	path := "shmx-mismatch.nic"
+	os.Remove(path)
+
+	key, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+
+	master := new(shmx.Shmx)
+	if err = master.AttachWithOptions(shmx.Master, path, 1, 1<<20, shmx.AttachOptions{AuthMode: shmx.AuthPSK, Key: key}); err != nil {
+		t.Fatalf("master.AttachWithOptions failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	err = slave.AttachWithOptions(shmx.Slave, path, 1, 1<<20, shmx.AttachOptions{})
+	if err == nil {
+		slave.Detach()
+		t.Fatal("slave.AttachWithOptions succeeded against a Master requiring AuthPSK, want error")
+	}
+}
+
+func TestWrongKeyFramesAreDropped(t *testing.T) {
+
+	path := "shmx-wrongkey.nic"
+	os.Remove(path)
+
+	masterKey, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+	slaveKey, err := shmx.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed %v", err)
+	}
+
+	master := new(shmx.Shmx)
+	if err = master.AttachWithOptions(shmx.Master, path, 1, 1<<20, shmx.AttachOptions{AuthMode: shmx.AuthPSK, Key: masterKey}); err != nil {
+		t.Fatalf("master.AttachWithOptions failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err = slave.AttachWithOptions(shmx.Slave, path, 1, 1<<20, shmx.AttachOptions{AuthMode: shmx.AuthPSK, Key: slaveKey}); err != nil {
+		t.Fatalf("slave.AttachWithOptions failed %v", err)
+	}
+	defer slave.Detach()
+
+	if _, err = slave.Write([]byte("injected by a slave with the wrong key")); err != nil {
+		t.Fatalf("slave.Write failed %v", err)
+	}
+
+	b := make([]byte, shmx.ShmxMaxLen)
+	n, err := master.Read(b)
+	if err != nil {
+		t.Fatalf("master.Read failed %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("master.Read returned %d bytes from a wrong-key slave, want the frame dropped", n)
+	}
+
+	var stats shmx.Stats
+	master.Stats(&stats)
+	if stats.RPktBadAuth != 1 {
+		t.Errorf("master RPktBadAuth = %d, want 1", stats.RPktBadAuth)
+	}
+}
+
+func BenchmarkWriteReadCopy(b *testing.B) {
+
+	path := "shmx-bench-copy.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	if err := master.Attach(shmx.Master, path); err != nil {
+		b.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err := slave.Attach(shmx.Slave, path); err != nil {
+		b.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	p := make([]byte, shmx.ShmxMaxLen)
+	out := make([]byte, shmx.ShmxMaxLen)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := master.Write(p); err != nil {
+			b.Fatalf("master.Write failed %v", err)
+		}
+		if _, err := slave.Read(out); err != nil {
+			b.Fatalf("slave.Read failed %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteReadZeroCopy(b *testing.B) {
+
+	path := "shmx-bench-zerocopy.nic"
+	os.Remove(path)
+
+	master := new(shmx.Shmx)
+	if err := master.Attach(shmx.Master, path); err != nil {
+		b.Fatalf("master.Attach failed %v", err)
+	}
+	defer master.Detach()
+
+	slave := new(shmx.Shmx)
+	if err := slave.Attach(shmx.Slave, path); err != nil {
+		b.Fatalf("slave.Attach failed %v", err)
+	}
+	defer slave.Detach()
+
+	p := make([]byte, shmx.ShmxMaxLen)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, commit, err := master.Reserve(len(p))
+		if err != nil {
+			b.Fatalf("master.Reserve failed %v", err)
+		}
+		copy(buf, p)
+		commit()
+
+		head, tail, release, err := slave.NextReadFrame()
+		if err != nil {
+			b.Fatalf("slave.NextReadFrame failed %v", err)
+		}
+		_ = head
+		_ = tail
+		release()
+	}
+}
@@ -0,0 +1,120 @@
+package shmx
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricPktRead = prometheus.NewDesc(
+		"shmx_packets_read_total", "Frames read from the ring.",
+		[]string{"path", "pair"}, nil)
+	metricPktWrote = prometheus.NewDesc(
+		"shmx_packets_written_total", "Frames written to the ring.",
+		[]string{"path", "pair"}, nil)
+	metricPktLost = prometheus.NewDesc(
+		"shmx_packets_lost_total", "Frames dropped because the ring was full or oversized.",
+		[]string{"path", "pair"}, nil)
+	metricBytesRead = prometheus.NewDesc(
+		"shmx_bytes_read_total", "Payload bytes read from the ring.",
+		[]string{"path", "pair"}, nil)
+	metricBytesWritten = prometheus.NewDesc(
+		"shmx_bytes_written_total", "Payload bytes written to the ring.",
+		[]string{"path", "pair"}, nil)
+	metricOccupancy = prometheus.NewDesc(
+		"shmx_occupancy_bytes", "Bytes currently buffered but not yet read.",
+		[]string{"path", "pair"}, nil)
+	metricHighWater = prometheus.NewDesc(
+		"shmx_high_water_bytes", "Highest tx-ring occupancy reached by this process's writes.",
+		[]string{"path", "pair"}, nil)
+	metricWrapCount = prometheus.NewDesc(
+		"shmx_wrap_total", "Frames written straddling the ring's wrap point.",
+		[]string{"path", "pair"}, nil)
+	metricBadAuth = prometheus.NewDesc(
+		"shmx_bad_auth_total", "Frames dropped for failing authentication.",
+		[]string{"path", "pair"}, nil)
+)
+
+// Describe implements prometheus.Collector.
+func (sm *Shmx) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(sm, ch)
+}
+
+// Collect implements prometheus.Collector, exposing Stats for every ring
+// pair this Shmx has attached.
+func (sm *Shmx) Collect(ch chan<- prometheus.Metric) {
+	if !sm.ready {
+		return
+	}
+
+	for i := range sm.pairs {
+		var s Stats
+		sm.StatsN(i, &s)
+		pair := strconv.Itoa(i)
+
+		ch <- prometheus.MustNewConstMetric(metricPktRead, prometheus.CounterValue, float64(s.RPktRead), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricPktWrote, prometheus.CounterValue, float64(s.WPktWrote), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricPktLost, prometheus.CounterValue, float64(s.WPktLost), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricBytesRead, prometheus.CounterValue, float64(s.BytesRead), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricBytesWritten, prometheus.CounterValue, float64(s.BytesWritten), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricOccupancy, prometheus.GaugeValue, float64(s.Occupancy), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricHighWater, prometheus.GaugeValue, float64(s.HighWater), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricWrapCount, prometheus.CounterValue, float64(s.WrapCount), sm.path, pair)
+		ch <- prometheus.MustNewConstMetric(metricBadAuth, prometheus.CounterValue, float64(s.RPktBadAuth), sm.path, pair)
+	}
+}
+
+// WriteMetrics writes Stats for every attached ring pair to w in plain-text
+// OpenMetrics exposition format, for operators who would rather scrape a
+// shmx-backed pipe directly than wire up a prometheus.Registry.
+func (sm *Shmx) WriteMetrics(w io.Writer) error {
+	if !sm.ready {
+		return fmt.Errorf("Not Initialized")
+	}
+
+	type line struct {
+		name string
+		help string
+		typ  string
+	}
+	lines := []line{
+		{"shmx_packets_read_total", "Frames read from the ring.", "counter"},
+		{"shmx_packets_written_total", "Frames written to the ring.", "counter"},
+		{"shmx_packets_lost_total", "Frames dropped because the ring was full or oversized.", "counter"},
+		{"shmx_bytes_read_total", "Payload bytes read from the ring.", "counter"},
+		{"shmx_bytes_written_total", "Payload bytes written to the ring.", "counter"},
+		{"shmx_occupancy_bytes", "Bytes currently buffered but not yet read.", "gauge"},
+		{"shmx_high_water_bytes", "Highest tx-ring occupancy reached by this process's writes.", "gauge"},
+		{"shmx_wrap_total", "Frames written straddling the ring's wrap point.", "counter"},
+		{"shmx_bad_auth_total", "Frames dropped for failing authentication.", "counter"},
+	}
+
+	values := make([][]uint64, len(sm.pairs))
+	for i := range sm.pairs {
+		var s Stats
+		sm.StatsN(i, &s)
+		values[i] = []uint64{
+			uint64(s.RPktRead), uint64(s.WPktWrote), uint64(s.WPktLost),
+			s.BytesRead, s.BytesWritten,
+			uint64(s.Occupancy), uint64(s.HighWater), uint64(s.WrapCount),
+			uint64(s.RPktBadAuth),
+		}
+	}
+
+	for m, l := range lines {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", l.name, l.help, l.name, l.typ); err != nil {
+			return err
+		}
+		for i := range sm.pairs {
+			if _, err := fmt.Fprintf(w, "%s{path=%q,pair=\"%d\"} %d\n", l.name, sm.path, i, values[i][m]); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "# EOF")
+	return err
+}
@@ -3,10 +3,15 @@ package shmx
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -19,26 +24,44 @@ const (
 	Master Control = 1
 	// Slave depends on the Master to create the shmx.
 	Slave Control = 2
+	// Observer attaches read-only: it claims no ring pair and can call
+	// Stats/StatsN/Occupancy on every pair, but not Read/Write/Reserve.
+	Observer Control = 3
 )
 
 const (
 	majorVersion = 1
-	minorVersion = 0
+	minorVersion = 3
 )
 
 const shmxFlagInit = 1
 
+// shmxFlagBlocking is set by a Master that supports futex-backed blocking
+// Read/Write (wire version 1.1+). A Slave that doesn't see it falls back
+// to poll mode.
+const shmxFlagBlocking = 2
+
+// shmxFlagSlaveBlocking is ORed into Flags by a Slave that will call
+// wakeReaders/wakeWriters, so a Master can tell a wake-capable Slave has
+// actually attached before trusting a blocking futex wait to be woken.
+const shmxFlagSlaveBlocking = 4
+
 type shmxConfig struct {
 	Major      byte
 	Minor      byte
 	RingPairs  byte
-	_          byte
+	AuthMode   byte
 	RingOffset uint32
 	RingStride uint32
 	Flags      uint32
+	EncMode    byte
+	_          [3]byte
+	// CbHeaderSize is the Master's cbheaderSize, read off the wire so a
+	// Slave never has to trust its own constant agrees with it.
+	CbHeaderSize uint32
 }
 
-const shmxConfigSize = 16
+const shmxConfigSize = 24
 const offsetConfigFlags = 12
 
 type cbheader struct {
@@ -50,32 +73,39 @@ type cbheader struct {
 	_         uint32
 	RIndex    uint32
 	RPktRead  uint32
+	Owner     uint32
+	RWaiters  uint32
+	WWaiters  uint32
 }
 
-// Stats of packets read, packets written, and packets lost by overrun.
+// Stats are the current statistics for one ring pair: wire-level packet
+// counters plus process-local gauges like bytes moved and occupancy.
 type Stats struct {
-	RPktRead  uint32
-	WPktWrote uint32
-	WPktLost  uint32
+	RPktRead       uint32
+	WPktWrote      uint32
+	WPktLost       uint32
+	RPktBadAuth    uint32
+	BytesRead      uint64
+	BytesWritten   uint64
+	Occupancy      uint32
+	HighWater      uint32
+	WrapCount      uint32
+	LastOpUnixNano int64
 }
 
-const cbheaderSize uint32 = 32
+const cbheaderSize uint32 = 44
 const offsetConstS uint32 = 0
 const offsetWIndex uint32 = 8
 const offsetWPktWr uint32 = 12
 const offsetWPktLo uint32 = 16
 const offsetRIndex uint32 = 24
 const offsetRPktRe uint32 = 28
+const offsetOwner uint32 = 32
+const offsetRWaiters uint32 = 36
+const offsetWWaiters uint32 = 40
 
-// Shmx is the Shared Memory Cross interface control block.
-//   rx = read cross, tx = transmit cross
-type Shmx struct {
-	role         Control
-	path         string
-	fd           int
-	m            []byte
-	size         int
-	ready        bool
+// shmxPair holds the rx/tx bookkeeping for one independent ring pair.
+type shmxPair struct {
 	rxCbOffset   uint32
 	rxOffsetBase uint32
 	rxOffsetWrap uint32
@@ -86,8 +116,48 @@ type Shmx struct {
 	txWIndexWrap uint32
 	rx           cbheader
 	tx           cbheader
-	r            io.Reader
-	w            io.Writer
+
+	// Process-local stats, not part of the wire format.
+	bytesRead    uint64
+	bytesWritten uint64
+	highWater    uint32
+	wrapCount    uint32
+	badAuth      uint32
+	lastOpNano   int64
+
+	// txNonce is this process's per-frame counter for the tx ring, carried
+	// on the wire so the peer can reconstruct the same AEAD nonce.
+	txNonce uint64
+}
+
+// Shmx is the Shared Memory Cross interface control block.
+//
+//	rx = read cross, tx = transmit cross
+type Shmx struct {
+	role             Control
+	path             string
+	fd               int
+	m                []byte
+	size             int
+	ready            bool
+	configRingOffset uint32
+	configRingStride uint32
+	pairs            []shmxPair
+	peerBlocking     bool
+	blockingR        bool
+	blockingW        bool
+	rdDeadline       time.Time
+	wrDeadline       time.Time
+	closed           int32
+	inflight         int32
+	r                io.Reader
+	w                io.Writer
+
+	// authMode and encMode are the negotiated AuthMode/EncMode for this
+	// attach, and aead is the keyed cipher they're served by; see auth.go.
+	authMode byte
+	encMode  byte
+	aead     cipher.AEAD
 }
 
 type pHeader struct {
@@ -101,6 +171,29 @@ const pHeaderSize = 12
 // ShmxMaxLen is the maximum transfer size.
 const ShmxMaxLen = (65535 + 18) // 18 = (ethernet + vlan tag).
 
+const (
+	defaultRingPairs = 1
+	defaultRingSize  = 12 * 1024 * 1024
+)
+
+// Channel is a per-ring-pair endpoint returned by Shmx.Channel. It lets a
+// Master address an individual ring pair directly instead of the default
+// (pair 0) used by Shmx.Read/Shmx.Write.
+type Channel struct {
+	sm *Shmx
+	i  int
+}
+
+// Read reads one frame from this channel's ring pair. See Shmx.Read.
+func (c *Channel) Read(p []byte) (int, error) {
+	return c.sm.ReadN(c.i, p)
+}
+
+// Write writes one frame to this channel's ring pair. See Shmx.Write.
+func (c *Channel) Write(p []byte) (int, error) {
+	return c.sm.WriteN(c.i, p)
+}
+
 func version(major byte, minor byte) string {
 	return fmt.Sprintf("%d.%d", major, minor)
 }
@@ -122,25 +215,92 @@ func (sm *Shmx) reset() {
 	sm.m = nil
 	sm.path = ""
 	sm.ready = false
+	sm.configRingOffset = 0
+	sm.configRingStride = 0
+	sm.pairs = nil
+	sm.peerBlocking = false
+	sm.blockingR = false
+	sm.blockingW = false
+	sm.rdDeadline = time.Time{}
+	sm.wrDeadline = time.Time{}
+	sm.authMode = AuthNone
+	sm.encMode = EncNone
+	sm.aead = nil
+	atomic.StoreInt32(&sm.closed, 0)
+	atomic.StoreInt32(&sm.inflight, 0)
 	return
 }
 
-// Stats are the current shmx statistics.
+// Stats reports the current statistics for ring pair 0. Equivalent to
+// StatsN(0, s).
 func (sm *Shmx) Stats(s *Stats) {
-	if !sm.ready {
-		s.RPktRead = 0
-		s.WPktWrote = 0
-		s.WPktLost = 0
+	sm.StatsN(0, s)
+}
+
+// StatsN reports the current statistics for ring pair i.
+func (sm *Shmx) StatsN(i int, s *Stats) {
+	*s = Stats{}
+
+	if !sm.ready || i < 0 || i >= len(sm.pairs) {
 		return
 	}
 
-	s.RPktRead = sm.rx.RPktRead
-	s.WPktWrote = sm.tx.WPktWrote
-	s.WPktLost = sm.tx.WPktLost
+	pr := &sm.pairs[i]
+
+	s.RPktRead = pr.rx.RPktRead
+	s.WPktWrote = pr.tx.WPktWrote
+	s.WPktLost = pr.tx.WPktLost
+	s.RPktBadAuth = pr.badAuth
+	s.BytesRead = pr.bytesRead
+	s.BytesWritten = pr.bytesWritten
+	s.HighWater = pr.highWater
+	s.WrapCount = pr.wrapCount
+	s.LastOpUnixNano = pr.lastOpNano
+
+	if occ, err := sm.Occupancy(i); err == nil {
+		s.Occupancy = occ
+	}
 }
 
-// Attach to the shared memory as either the Master or Slave.
+// Occupancy returns the bytes buffered but not yet read on ring pair i's
+// rx ring, sampled via two independent atomic loads of WIndex/RIndex
+// (they're 16 bytes apart, so not a single combined snapshot).
+func (sm *Shmx) Occupancy(i int) (uint32, error) {
+	if !sm.ready {
+		return 0, fmt.Errorf("Not Initialized")
+	}
+	if i < 0 || i >= len(sm.pairs) {
+		return 0, fmt.Errorf("invalid ring pair %d", i)
+	}
+
+	pr := &sm.pairs[i]
+	w := atomic.LoadUint32(sm.u32Addr(pr.rxCbOffset + offsetWIndex))
+	r := atomic.LoadUint32(sm.u32Addr(pr.rxCbOffset + offsetRIndex))
+
+	if w >= r {
+		return w - r, nil
+	}
+	return pr.rx.ConstSize - (r - w), nil
+}
+
+// Attach to the shared memory as either the Master or Slave, provisioning a
+// single ring pair. Equivalent to AttachN(role, path, 1, defaultRingSize).
 func (sm *Shmx) Attach(role Control, path string) error {
+	return sm.AttachN(role, path, defaultRingPairs, defaultRingSize)
+}
+
+// AttachN attaches as Master, Slave, or Observer. As Master it provisions
+// ringPairs independent ring pairs of ringSize bytes each; a Slave or
+// Observer reads the layout off the Master's config block instead and
+// ignores both, though ringPairs must still be between 1 and 255. Use
+// Channel to address a ring pair directly.
+func (sm *Shmx) AttachN(role Control, path string, ringPairs int, ringSize int) error {
+	return sm.AttachWithOptions(role, path, ringPairs, ringSize, AttachOptions{})
+}
+
+// AttachWithOptions is AttachN plus opts, which negotiates per-frame
+// authentication and encryption. See AttachOptions.
+func (sm *Shmx) AttachWithOptions(role Control, path string, ringPairs int, ringSize int, opts AttachOptions) error {
 
 	var err error
 
@@ -148,14 +308,24 @@ func (sm *Shmx) Attach(role Control, path string) error {
 		return errors.New("Inuse")
 	}
 
+	if ringPairs <= 0 || ringPairs > 255 {
+		return errors.New("invalid ringPairs")
+	}
+
+	if err = opts.validate(); err != nil {
+		return err
+	}
+
 	sm.role = role
 	sm.path = path
 
 	switch role {
 	case Master:
-		err = sm.createMaster()
+		err = sm.createMaster(ringPairs, ringSize, opts)
 	case Slave:
-		err = sm.createSlave()
+		err = sm.createSlave(opts)
+	case Observer:
+		err = sm.createObserver()
 	default:
 		err = errors.New("invalid role")
 	}
@@ -167,30 +337,44 @@ func (sm *Shmx) Attach(role Control, path string) error {
 	return err
 }
 
-func (sm *Shmx) createMaster() error {
+// Channel returns the endpoint for ring pair i, letting a Master talk to a
+// specific Slave independently of any other attached pair.
+func (sm *Shmx) Channel(i int) (io.ReadWriter, error) {
+	if !sm.ready || i < 0 || i >= len(sm.pairs) {
+		return nil, fmt.Errorf("invalid ring pair %d", i)
+	}
+	return &Channel{sm: sm, i: i}, nil
+}
+
+func (sm *Shmx) createMaster(ringPairs int, ringSize int, opts AttachOptions) error {
 
 	var err error
 
+	sm.aead, err = newAEAD(opts)
+	if err != nil {
+		return err
+	}
+	sm.authMode = opts.AuthMode
+	sm.encMode = opts.EncMode
+
 	sm.fd, err = unix.Open(sm.path, unix.O_CREAT|unix.O_EXCL|unix.O_RDWR, unix.S_IRUSR|unix.S_IWUSR)
 	if err != nil {
 		return fmt.Errorf("open failed %s: %v", sm.path, err)
 	}
 
-	const (
-		masterRingPairs = 1
-		masterRingSize  = 12 * 1024 * 1024
-	)
-
 	var tcb shmxConfig
 
-	tcb.Major = 1
-	tcb.Minor = 0
-	tcb.RingPairs = masterRingPairs
+	tcb.Major = majorVersion
+	tcb.Minor = minorVersion
+	tcb.RingPairs = byte(ringPairs)
+	tcb.AuthMode = opts.AuthMode
 	tcb.RingOffset = shmxConfigSize
-	tcb.RingStride = masterRingSize
-	tcb.Flags = 0
+	tcb.RingStride = uint32(ringSize)
+	tcb.Flags = shmxFlagBlocking
+	tcb.EncMode = opts.EncMode
+	tcb.CbHeaderSize = cbheaderSize
 
-	sm.size = shmxConfigSize + (masterRingSize * masterRingPairs * 2)
+	sm.size = shmxConfigSize + (ringSize * ringPairs * 2)
 
 	err = unix.Ftruncate(sm.fd, int64(sm.size))
 	if err != nil {
@@ -217,38 +401,71 @@ func (sm *Shmx) createMaster() error {
 		return fmt.Errorf("unix.Msync failed: %v ", err)
 	}
 
-	// Initialize each ring to an empty state.  Two rings per pair.
+	// Initialize each ring to an empty state. Two rings per pair.
 	i := shmxConfigSize
-	for r := 0; r < (masterRingPairs * 2); r++ {
-		err = sm.initRing(sm.m[i:], masterRingSize)
+	for r := 0; r < (ringPairs * 2); r++ {
+		err = sm.initRing(sm.m[i:], uint32(ringSize))
 		if err != nil {
 			return fmt.Errorf("sm.initRing failed %s: %v ", sm.path, err)
 		}
-		i += masterRingSize
+		i += ringSize
 	}
 
-	// Note the reversal between master and slave.
-	sm.rxCbOffset = tcb.RingOffset
-	sm.txCbOffset = tcb.RingOffset + tcb.RingStride
-	sm.initOffsets(tcb.RingStride)
-	sm.getConstSize()
+	sm.configRingOffset = tcb.RingOffset
+	sm.configRingStride = tcb.RingStride
+	sm.initPairOffsets(ringPairs, cbheaderSize)
+	for p := range sm.pairs {
+		sm.getConstSize(p)
+	}
 
 	sm.ready = true
-	binary.LittleEndian.PutUint32(sm.m[offsetConfigFlags:], uint32(shmxFlagInit))
+	binary.LittleEndian.PutUint32(sm.m[offsetConfigFlags:], uint32(shmxFlagInit|shmxFlagBlocking))
 
 	return nil
 }
 
-func (sm *Shmx) initOffsets(ringStride uint32) {
-	sm.rxOffsetBase = sm.rxCbOffset + cbheaderSize
-	sm.txOffsetBase = sm.txCbOffset + cbheaderSize
-	sm.rxOffsetWrap = sm.rxCbOffset + ringStride
-	sm.txOffsetWrap = sm.txCbOffset + ringStride
-	sm.rxRIndexWrap = sm.rxOffsetWrap - sm.rxOffsetBase
-	sm.txWIndexWrap = sm.txOffsetWrap - sm.txOffsetBase
+// initPairOffsets lays out ringPairs ring pairs from sm.configRingOffset;
+// roles are reversed between Master and Slave. headerSize is the
+// Master's actual cbheaderSize, so offsets agree even across a mismatched
+// constant.
+func (sm *Shmx) initPairOffsets(ringPairs int, headerSize uint32) {
+	stride := sm.configRingStride
+	sm.pairs = make([]shmxPair, ringPairs)
+	for i := range sm.pairs {
+		base := sm.configRingOffset + uint32(i)*stride*2
+		p := &sm.pairs[i]
+		if sm.role == Master {
+			p.rxCbOffset = base
+			p.txCbOffset = base + stride
+		} else {
+			p.txCbOffset = base
+			p.rxCbOffset = base + stride
+		}
+		p.rxOffsetBase = p.rxCbOffset + headerSize
+		p.txOffsetBase = p.txCbOffset + headerSize
+		p.rxOffsetWrap = p.rxCbOffset + stride
+		p.txOffsetWrap = p.txCbOffset + stride
+		p.rxRIndexWrap = p.rxOffsetWrap - p.rxOffsetBase
+		p.txWIndexWrap = p.txOffsetWrap - p.txOffsetBase
+	}
 }
 
-func (sm *Shmx) createSlave() error {
+// pairOwnerOffset is the file offset of ring pair i's owner word: ring "A"
+// of the pair, which is the same absolute address for Master and Slave.
+func (sm *Shmx) pairOwnerOffset(i int) uint32 {
+	return sm.configRingOffset + uint32(i)*sm.configRingStride*2 + offsetOwner
+}
+
+// claimRingPair attempts to atomically claim ring pair i for this process
+// via a CAS on its owner word, so concurrently-attaching Slaves each land
+// on a distinct pair.
+func (sm *Shmx) claimRingPair(i int) bool {
+	off := sm.pairOwnerOffset(i)
+	addr := (*uint32)(unsafe.Pointer(&sm.m[off]))
+	return atomic.CompareAndSwapUint32(addr, 0, uint32(os.Getpid()))
+}
+
+func (sm *Shmx) createSlave(opts AttachOptions) error {
 
 	var err error
 
@@ -281,9 +498,29 @@ func (sm *Shmx) createSlave() error {
 	fmt.Printf("Slave ring_stride: %d\n", tcb.RingStride)
 	fmt.Printf("Slave flags:       %d\n", tcb.Flags)
 
-	if tcb.Major != majorVersion || tcb.Minor != minorVersion {
+	if tcb.Major != majorVersion {
 		return errors.New("Unexpected version")
 	}
+
+	// Differing Minor versions interoperate when the Master's config block
+	// carries CbHeaderSize: initPairOffsets below uses tcb.CbHeaderSize, not
+	// this binary's constant, to lay out offsets. A 1.0 Master's 16-byte
+	// config block has no such field, reads as 0 here, and is rejected.
+	if tcb.CbHeaderSize == 0 {
+		return errors.New("shmx: master reports cbheaderSize 0")
+	}
+
+	if tcb.AuthMode != opts.AuthMode || tcb.EncMode != opts.EncMode {
+		return fmt.Errorf("shmx: auth/enc mode mismatch: master requires AuthMode=%d EncMode=%d", tcb.AuthMode, tcb.EncMode)
+	}
+
+	sm.aead, err = newAEAD(opts)
+	if err != nil {
+		return err
+	}
+	sm.authMode = opts.AuthMode
+	sm.encMode = opts.EncMode
+
 	sm.size = int(tcb.RingOffset) + (int(tcb.RingStride) * int(tcb.RingPairs) * 2)
 
 	fmt.Println("Slave Total size: ", sm.size)
@@ -293,20 +530,98 @@ func (sm *Shmx) createSlave() error {
 		return fmt.Errorf("binary.Mmap failed %s: %v ", sm.path, err)
 	}
 
-	// Note the reversal between master and slave.
-	sm.txCbOffset = tcb.RingOffset
-	sm.rxCbOffset = tcb.RingOffset + tcb.RingStride
-	sm.initOffsets(tcb.RingStride)
+	sm.configRingOffset = tcb.RingOffset
+	sm.configRingStride = tcb.RingStride
+	sm.initPairOffsets(int(tcb.RingPairs), tcb.CbHeaderSize)
+
+	flags := binary.LittleEndian.Uint32(sm.m[offsetConfigFlags:])
+	if flags&shmxFlagInit == 0 {
+		sm.Detach()
+		return fmt.Errorf("Flags not shmxFlagInit")
+	}
+	sm.peerBlocking = flags&shmxFlagBlocking != 0
+	sm.setFlag(shmxFlagSlaveBlocking)
+
+	claimed := -1
+	for i := 0; i < len(sm.pairs); i++ {
+		if sm.claimRingPair(i) {
+			claimed = i
+			break
+		}
+	}
+	if claimed == -1 {
+		sm.Detach()
+		return errors.New("no free ring pair")
+	}
+	sm.pairs = sm.pairs[claimed : claimed+1]
+
+	sm.getConstSize(0)
+
+	fmt.Printf("Slave ring pair:  %d\n", claimed)
+	fmt.Printf("Slave tx offset: %d\n", sm.pairs[0].txOffsetBase)
+	fmt.Printf("Slave rx offset: %d\n", sm.pairs[0].rxOffsetBase)
+	sm.ready = true
+	return nil
+}
+
+// createObserver attaches read-only: PROT_READ mmap, no ring pair claimed,
+// so sm.pairs stays fully visible for Stats/StatsN/Occupancy.
+func (sm *Shmx) createObserver() error {
+
+	var err error
+
+	sm.fd, err = unix.Open(sm.path, unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open failed %s: %v", sm.path, err)
+	}
 
-	if binary.LittleEndian.Uint32(sm.m[offsetConfigFlags:]) != shmxFlagInit {
+	b := make([]byte, shmxConfigSize)
+
+	n, err := unix.Read(sm.fd, b)
+	if err != nil {
+		return fmt.Errorf("read failed %s: %v", sm.path, err)
+	}
+
+	if n != shmxConfigSize {
+		return fmt.Errorf("Init configBlock mishap, read short  %d:%d", n, shmxConfigSize)
+	}
+
+	buf := bytes.NewBuffer(b)
+	var tcb shmxConfig
+	err = binary.Read(buf, binary.LittleEndian, &tcb)
+	if err != nil {
+		return fmt.Errorf("binary.Read failed %s: %v ", sm.path, err)
+	}
+
+	if tcb.Major != majorVersion {
+		return errors.New("Unexpected version")
+	}
+
+	if tcb.CbHeaderSize == 0 {
+		return errors.New("shmx: master reports cbheaderSize 0")
+	}
+
+	sm.size = int(tcb.RingOffset) + (int(tcb.RingStride) * int(tcb.RingPairs) * 2)
+
+	sm.m, err = unix.Mmap(sm.fd, 0, sm.size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("unix.Mmap failed %s: %v ", sm.path, err)
+	}
+
+	sm.configRingOffset = tcb.RingOffset
+	sm.configRingStride = tcb.RingStride
+	sm.initPairOffsets(int(tcb.RingPairs), tcb.CbHeaderSize)
+
+	flags := binary.LittleEndian.Uint32(sm.m[offsetConfigFlags:])
+	if flags&shmxFlagInit == 0 {
 		sm.Detach()
 		return fmt.Errorf("Flags not shmxFlagInit")
 	}
 
-	sm.getConstSize()
+	for p := range sm.pairs {
+		sm.getConstSize(p)
+	}
 
-	fmt.Printf("Slave tx offset: %d\n", sm.txOffsetBase)
-	fmt.Printf("Slave rx offset: %d\n", sm.rxOffsetBase)
 	sm.ready = true
 	return nil
 }
@@ -322,6 +637,9 @@ func (sm *Shmx) initRing(ring []byte, size uint32) error {
 	hdr.WPktLost = 0
 	hdr.RIndex = 0
 	hdr.RPktRead = 0
+	hdr.Owner = 0
+	hdr.RWaiters = 0
+	hdr.WWaiters = 0
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.LittleEndian, &hdr)
 	if err != nil {
@@ -351,163 +669,672 @@ func round32(n int) int {
 	return (n + 3) & ^3
 }
 
+// Write writes p as a single frame on ring pair 0. Equivalent to WriteN(0, p).
 func (sm *Shmx) Write(p []byte) (n int, err error) {
+	return sm.WriteN(0, p)
+}
 
-	if !sm.ready {
-		return 0, fmt.Errorf("Not Initialized")
+// WriteN writes p as a single frame on ring pair i. It is a thin wrapper
+// around ReserveN that copies p into the reserved region and commits it.
+func (sm *Shmx) WriteN(i int, p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	if len(p) == 0 {
+	buf, commit, err := sm.ReserveN(i, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if buf == nil {
+		// Ring full in non-blocking mode, or blocked peer gone: dropped,
+		// matching the legacy poll-and-return behavior.
 		return 0, nil
 	}
 
-	if len(p) > ShmxMaxLen {
-		sm.tx.WPktLost++
-		return 0, fmt.Errorf("Too Big")
+	copy(buf, p)
+	commit()
+
+	return len(p), nil
+}
+
+// Reserve reserves room for an n-byte frame on ring pair 0 and returns the
+// payload region for the caller to fill in place. Equivalent to
+// ReserveN(0, n).
+func (sm *Shmx) Reserve(n int) (buf []byte, commit func(), err error) {
+	return sm.ReserveN(0, n)
+}
+
+// ReserveN reserves room for an n-byte frame on ring pair i without
+// copying: it blocks or drops under the same rules as WriteN, then hands
+// back the tx ring's payload region for the caller to fill directly and
+// commit. A frame straddling the wrap point falls back to a scratch
+// buffer that commit copies in, same as WriteN.
+func (sm *Shmx) ReserveN(i int, n int) (buf []byte, commit func(), err error) {
+	if !sm.ready {
+		return nil, nil, fmt.Errorf("Not Initialized")
 	}
 
-	sm.refreshTxCB()
+	if sm.role == Observer {
+		return nil, nil, fmt.Errorf("shmx: Observer is read-only")
+	}
 
-	var space int
+	if i < 0 || i >= len(sm.pairs) {
+		return nil, nil, fmt.Errorf("invalid ring pair %d", i)
+	}
 
-	// Calculate free space for transmitting.
-	if sm.tx.WIndex >= sm.tx.RIndex {
-		space = int(sm.tx.ConstSize - (sm.tx.WIndex - sm.tx.RIndex))
-	} else {
-		space = int(sm.tx.RIndex - sm.tx.WIndex)
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("invalid reservation size %d", n)
 	}
 
-	// Enough space for: packet header and the data
-	if space < pHeaderSize+round32(len(p)) {
-		sm.tx.WPktLost++
-		sm.putTxCB()
-		return 0, nil
+	if n > ShmxMaxLen {
+		sm.pairs[i].tx.WPktLost++
+		return nil, nil, fmt.Errorf("Too Big")
 	}
 
-	pHdr := pHeader{}
-	pHdr.len = uint32(len(p))
-	pHdr.tag = 0
-	pHdr.rd = 0
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, &pHdr)
-	if err != nil {
-		return 0, fmt.Errorf("binary.Write pHdr failed %s: %v ", sm.path, err)
+	atomic.AddInt32(&sm.inflight, 1)
+	defer atomic.AddInt32(&sm.inflight, -1)
+
+	pr := &sm.pairs[i]
+	need := int(sm.frameHeaderSize()) + round32(n)
+
+	for {
+		sm.refreshTxCB(i)
+
+		var space int
+
+		// Calculate free space for transmitting.
+		if pr.tx.WIndex >= pr.tx.RIndex {
+			space = int(pr.tx.ConstSize - (pr.tx.WIndex - pr.tx.RIndex))
+		} else {
+			space = int(pr.tx.RIndex - pr.tx.WIndex)
+		}
+
+		// Enough space for: packet header and the data
+		if space >= need {
+			break
+		}
+
+		if atomic.LoadInt32(&sm.closed) != 0 {
+			return nil, nil, io.EOF
+		}
+
+		if !sm.canBlockWrite() {
+			pr.tx.WPktLost++
+			sm.putTxCB(i)
+			return nil, nil, nil
+		}
+
+		if err = sm.waitForSpace(i); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	sm.put(buf.Bytes())
-	sm.put(p)
+	if int(pr.txWIndexWrap-pr.tx.WIndex) >= need {
+		at := pr.tx.WIndex
+		idx := pr.txOffsetBase + at + sm.frameHeaderSize()
+		buf = sm.m[idx : idx+uint32(n)]
+		commit = func() {
+			var nonce uint64
+			var tag [authTagSize]byte
+			if sm.authMode != AuthNone {
+				ad, err := encodeHeader(uint32(n))
+				if err != nil {
+					panic(err)
+				}
+				nonce, tag = sm.sealFrame(i, ad, buf)
+			}
+			sm.putFrameHeader(i, at, uint32(n), nonce, tag)
+			pr.tx.WIndex = at + uint32(need)
+			pr.tx.WPktWrote++
+			sm.putTxCB(i)
+			sm.recordWrite(i, n)
+			sm.wakeReaders(i)
+		}
+		return buf, commit, nil
+	}
 
-	sm.tx.WIndex = uint32(round32(int(sm.tx.WIndex)))
-	sm.tx.WPktWrote++
-	sm.putTxCB()
+	// The frame would straddle the wrap point: ReserveN promises a single
+	// contiguous slice, so fill a scratch buffer here and let put() split
+	// it across the wrap, same as WriteN, when commit is called.
+	buf = make([]byte, n)
+	commit = func() {
+		ad, err := encodeHeader(uint32(n))
+		if err != nil {
+			panic(err)
+		}
 
-	return len(p), nil
+		var nonce uint64
+		var tag [authTagSize]byte
+		if sm.authMode != AuthNone {
+			nonce, tag = sm.sealFrame(i, ad, buf)
+		}
+
+		sm.put(i, sm.encodeFullHeader(ad, nonce, tag))
+		sm.put(i, buf)
+		pr.tx.WIndex = uint32(round32(int(pr.tx.WIndex)))
+		pr.tx.WPktWrote++
+		sm.putTxCB(i)
+		pr.wrapCount++
+		sm.recordWrite(i, n)
+		sm.wakeReaders(i)
+	}
+	return buf, commit, nil
+}
+
+// recordWrite updates the process-local stats for ring pair i after a
+// commit has published n payload bytes, tracking the high-water mark
+// alongside the plain byte counter so Stats/Collect stay cheap to read.
+func (sm *Shmx) recordWrite(i int, n int) {
+	pr := &sm.pairs[i]
+	pr.bytesWritten += uint64(n)
+	pr.lastOpNano = time.Now().UnixNano()
+
+	var occ uint32
+	if pr.tx.WIndex >= pr.tx.RIndex {
+		occ = pr.tx.WIndex - pr.tx.RIndex
+	} else {
+		occ = pr.tx.ConstSize - (pr.tx.RIndex - pr.tx.WIndex)
+	}
+	if occ > pr.highWater {
+		pr.highWater = occ
+	}
+}
+
+// encodeHeader serializes a pHeader for a frame of the given payload length.
+func encodeHeader(length uint32) ([]byte, error) {
+	pHdr := pHeader{len: length}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, &pHdr); err != nil {
+		return nil, fmt.Errorf("binary.Write pHdr failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// putFrameHeader writes a frame header at tx offset "at" on ring pair i,
+// which the caller has already verified fits without wrapping. nonce and
+// tag are only written, extending the header past pHeaderSize, when this
+// attach negotiated AuthMode != AuthNone; see frameHeaderSize.
+func (sm *Shmx) putFrameHeader(i int, at uint32, length uint32, nonce uint64, tag [authTagSize]byte) {
+	pr := &sm.pairs[i]
+	idx := pr.txOffsetBase + at
+	binary.LittleEndian.PutUint32(sm.m[idx:], length)
+	binary.LittleEndian.PutUint32(sm.m[idx+4:], 0)
+	binary.LittleEndian.PutUint32(sm.m[idx+8:], 0)
+	if sm.authMode == AuthNone {
+		return
+	}
+	binary.LittleEndian.PutUint64(sm.m[idx+pHeaderSize:], nonce)
+	copy(sm.m[idx+pHeaderSize+8:idx+pHeaderSize+8+authTagSize], tag[:])
 }
 
-func (sm *Shmx) put(b []byte) {
-	i := int(sm.txOffsetBase + sm.tx.WIndex)
-	n := copy(sm.m[i:sm.txOffsetWrap], b)
+func (sm *Shmx) put(i int, b []byte) {
+	pr := &sm.pairs[i]
+	idx := int(pr.txOffsetBase + pr.tx.WIndex)
+	n := copy(sm.m[idx:pr.txOffsetWrap], b)
 	if n == len(b) {
 		// got it all
-		sm.tx.WIndex += uint32(n)
+		pr.tx.WIndex += uint32(n)
 		return
 	}
 
 	// Wrap for the rest.
-	m := copy(sm.m[sm.txOffsetBase:sm.txOffsetWrap], b[n:])
+	m := copy(sm.m[pr.txOffsetBase:pr.txOffsetWrap], b[n:])
 	if n+m != len(b) {
 		panic("put is broken")
 	}
-	sm.tx.WIndex = uint32(m)
+	pr.tx.WIndex = uint32(m)
 	return
 }
 
+// Read reads one frame from ring pair 0 into b. Equivalent to ReadN(0, b).
 func (sm *Shmx) Read(b []byte) (n int, err error) {
+	return sm.ReadN(0, b)
+}
+
+// ReadN reads one frame from ring pair i into b. It is a thin wrapper
+// around NextReadFrameN that copies the borrowed frame into b and
+// releases it.
+func (sm *Shmx) ReadN(i int, b []byte) (n int, err error) {
+	head, tail, release, err := sm.NextReadFrameN(i)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil && tail == nil {
+		return 0, nil
+	}
+
+	if len(b) < len(head)+len(tail) {
+		return 0, fmt.Errorf("len(b) %d < length %d", len(b), len(head)+len(tail))
+	}
+
+	n = copy(b, head)
+	n += copy(b[n:], tail)
+	release()
+
+	return n, nil
+}
+
+// NextReadFrame borrows the next frame on ring pair 0 without copying.
+// Equivalent to NextReadFrameN(0).
+func (sm *Shmx) NextReadFrame() (head []byte, tail []byte, release func(), err error) {
+	return sm.NextReadFrameN(0)
+}
+
+// NextReadFrameN borrows the next frame on ring pair i as slices pointing
+// directly into the mmap: head is the whole frame, and tail is nil unless
+// the frame straddles the wrap point. (nil, nil) means no frame available.
+// Zero-copy holds for AuthMode == AuthNone and for auth-only (EncMode ==
+// EncNone); EncMode != EncNone decrypts into a fresh heap buffer instead.
+//
+// release must be called exactly once to advance RIndex; until then the
+// frame's space isn't freed and calling this again returns the same frame.
+func (sm *Shmx) NextReadFrameN(i int) (head []byte, tail []byte, release func(), err error) {
 	if !sm.ready {
-		return 0, fmt.Errorf("Not Initilized")
+		return nil, nil, nil, fmt.Errorf("Not Initilized")
 	}
 
-	sm.refreshRxCB()
+	if sm.role == Observer {
+		return nil, nil, nil, fmt.Errorf("shmx: Observer is read-only")
+	}
 
-	if sm.rx.WPktWrote == sm.rx.RPktRead {
-		return 0, nil
+	if i < 0 || i >= len(sm.pairs) {
+		return nil, nil, nil, fmt.Errorf("invalid ring pair %d", i)
+	}
+
+	atomic.AddInt32(&sm.inflight, 1)
+	defer atomic.AddInt32(&sm.inflight, -1)
+
+	pr := &sm.pairs[i]
+
+	for {
+		for {
+			sm.refreshRxCB(i)
+
+			if pr.rx.WPktWrote != pr.rx.RPktRead {
+				break
+			}
+
+			if atomic.LoadInt32(&sm.closed) != 0 {
+				return nil, nil, nil, io.EOF
+			}
+
+			if !sm.canBlockRead() {
+				return nil, nil, nil, nil
+			}
+
+			if err = sm.waitForData(i); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+		at := pr.rx.RIndex
+		var length, tag, rd uint32
+		length, at = sm.peekUint32(i, at)
+		tag, at = sm.peekUint32(i, at)
+		rd, at = sm.peekUint32(i, at)
+
+		if tag != 0 {
+			panic("tag not zero")
+		}
+
+		if rd != 0 {
+			panic("rd not zero")
+		}
+
+		var wireNonce uint64
+		var authTag [authTagSize]byte
+		if sm.authMode != AuthNone {
+			wireNonce, at = sm.peekUint64(i, at)
+			authTag, at = sm.peekAuthTag(i, at)
+		}
+
+		// Do we need to wrap?
+		var m uint32
+		if at+length > pr.rxRIndexWrap {
+			m = pr.rxRIndexWrap - at
+			head = sm.m[pr.rxOffsetBase+at : pr.rxOffsetWrap]
+			at = 0
+		}
+
+		idx := pr.rxOffsetBase + at
+		payload := sm.m[idx : idx+length-m]
+		if m == 0 {
+			head = payload
+		} else {
+			tail = payload
+		}
+
+		newRIndex := at + uint32(round32(int(length-m)))
+		if newRIndex >= pr.rxRIndexWrap {
+			newRIndex = 0
+		}
+
+		if sm.authMode != AuthNone {
+			ad, aerr := encodeHeader(length)
+			if aerr != nil {
+				panic(aerr)
+			}
+
+			var ok bool
+			if sm.encMode == EncNone {
+				// Auth-only: verify in place against the mmap-backed
+				// head/tail directly, so a successful verification leaves
+				// the zero-copy contract intact.
+				ok = sm.verifyFrame(i, ad, head, tail, wireNonce, authTag)
+			} else {
+				var plain []byte
+				plain, ok = sm.openFrame(i, ad, append(append([]byte{}, head...), tail...), wireNonce, authTag)
+				if ok {
+					head, tail = plain, nil
+				}
+			}
+			if !ok {
+				// Bad tag: a wrong key, corruption, or an attacker's frame.
+				// Drop it and keep waiting, same as a legitimate frame never
+				// having arrived.
+				pr.badAuth++
+				pr.rx.RIndex = newRIndex
+				pr.rx.RPktRead++
+				sm.putRxCB(i)
+				sm.wakeWriters(i)
+				continue
+			}
+		}
+
+		total := len(head) + len(tail)
+		released := false
+		release = func() {
+			if released {
+				return
+			}
+			released = true
+			pr.rx.RIndex = newRIndex
+			pr.rx.RPktRead++
+			sm.putRxCB(i)
+			pr.bytesRead += uint64(total)
+			pr.lastOpNano = time.Now().UnixNano()
+			sm.wakeWriters(i)
+		}
+
+		return head, tail, release, nil
 	}
+}
 
-	length := sm.getUint32()
-	tag := sm.getUint32()
-	rd := sm.getUint32()
+// peekUint32 reads the uint32 at rx offset "at" on ring pair i without
+// mutating any state, returning the wrapped-forward offset past it.
+func (sm *Shmx) peekUint32(i int, at uint32) (u uint32, next uint32) {
+	pr := &sm.pairs[i]
+	idx := int(pr.rxOffsetBase + at)
+	u = binary.LittleEndian.Uint32(sm.m[idx:])
+	next = at + 4
+	if next == pr.rxRIndexWrap {
+		next = 0
+	}
+	return u, next
+}
 
-	if len(b) < int(length) {
-		return 0, fmt.Errorf("len(b) %d < length %d", len(b), length)
+// peekUint64 reads the little-endian uint64 at rx offset "at" as two
+// peekUint32 reads, so it wraps the same way.
+func (sm *Shmx) peekUint64(i int, at uint32) (u uint64, next uint32) {
+	var lo, hi uint32
+	lo, at = sm.peekUint32(i, at)
+	hi, next = sm.peekUint32(i, at)
+	return uint64(lo) | uint64(hi)<<32, next
+}
+
+// peekAuthTag reads the 16-byte AEAD tag at rx offset "at" on ring pair i,
+// four uint32s at a time for the same reason as peekUint64.
+func (sm *Shmx) peekAuthTag(i int, at uint32) (tag [authTagSize]byte, next uint32) {
+	next = at
+	for b := 0; b < authTagSize; b += 4 {
+		var w uint32
+		w, next = sm.peekUint32(i, next)
+		binary.LittleEndian.PutUint32(tag[b:], w)
 	}
+	return tag, next
+}
+
+func (sm *Shmx) getConstSize(i int) {
+	pr := &sm.pairs[i]
+	pr.rx.ConstSize = binary.LittleEndian.Uint32(sm.m[pr.rxCbOffset+offsetConstS:])
+	pr.tx.ConstSize = binary.LittleEndian.Uint32(sm.m[pr.txCbOffset+offsetConstS:])
+}
 
-	if tag != 0 {
-		panic("tag not zero")
+func (sm *Shmx) refreshRxCB(i int) {
+	pr := &sm.pairs[i]
+	pr.rx.WIndex = binary.LittleEndian.Uint32(sm.m[pr.rxCbOffset+offsetWIndex:])
+	pr.rx.WPktWrote = binary.LittleEndian.Uint32(sm.m[pr.rxCbOffset+offsetWPktWr:])
+	pr.rx.WPktLost = binary.LittleEndian.Uint32(sm.m[pr.rxCbOffset+offsetWPktLo:])
+}
+
+func (sm *Shmx) putRxCB(i int) {
+	pr := &sm.pairs[i]
+	binary.LittleEndian.PutUint32(sm.m[pr.rxCbOffset+offsetRIndex:], pr.rx.RIndex)
+	binary.LittleEndian.PutUint32(sm.m[pr.rxCbOffset+offsetRPktRe:], pr.rx.RPktRead)
+}
+
+func (sm *Shmx) refreshTxCB(i int) {
+	pr := &sm.pairs[i]
+	pr.tx.RIndex = binary.LittleEndian.Uint32(sm.m[pr.txCbOffset+offsetRIndex:])
+	pr.tx.RPktRead = binary.LittleEndian.Uint32(sm.m[pr.txCbOffset+offsetRPktRe:])
+}
+
+func (sm *Shmx) putTxCB(i int) {
+	pr := &sm.pairs[i]
+	binary.LittleEndian.PutUint32(sm.m[pr.txCbOffset+offsetWIndex:], pr.tx.WIndex)
+	binary.LittleEndian.PutUint32(sm.m[pr.txCbOffset+offsetWPktWr:], pr.tx.WPktWrote)
+	binary.LittleEndian.PutUint32(sm.m[pr.txCbOffset+offsetWPktLo:], pr.tx.WPktLost)
+}
+
+// timeoutError is returned by Read/Write when a deadline set with
+// SetDeadline/SetReadDeadline/SetWriteDeadline elapses, matching the
+// net.Error semantics net.Conn users expect.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "shmx: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout error = timeoutError{}
+
+// SetDeadline sets both the read and write deadlines, as with net.Conn.
+// Calling it (even with a zero time.Time, meaning "no deadline") switches
+// Read/Write from today's poll-and-return-immediately behavior into
+// blocking mode: they sleep until data/space is available, the deadline
+// elapses, or Close is called.
+func (sm *Shmx) SetDeadline(t time.Time) error {
+	if err := sm.SetReadDeadline(t); err != nil {
+		return err
 	}
+	return sm.SetWriteDeadline(t)
+}
 
-	if rd != 0 {
-		panic("rd not zero")
+// SetReadDeadline arms blocking mode for Read; see SetDeadline.
+func (sm *Shmx) SetReadDeadline(t time.Time) error {
+	sm.blockingR = true
+	sm.rdDeadline = t
+	return nil
+}
+
+// SetWriteDeadline arms blocking mode for Write; see SetDeadline.
+func (sm *Shmx) SetWriteDeadline(t time.Time) error {
+	sm.blockingW = true
+	sm.wrDeadline = t
+	return nil
+}
+
+// Close interrupts any Read/Write currently blocked on this Shmx with
+// io.EOF and marks it closed; it does not unmap or unlink, see Detach.
+// It blocks until every in-flight Read/Write has unwound, so a caller
+// that follows with Detach never races Munmap against one still running.
+func (sm *Shmx) Close() error {
+	if !sm.ready {
+		return nil
+	}
+	atomic.StoreInt32(&sm.closed, 1)
+	for i := range sm.pairs {
+		pr := &sm.pairs[i]
+		// sm.wakeReaders/wakeWriters wake the peer; a goroutine blocked in
+		// our own local Read/Write waits on our own addresses, so wake
+		// those directly too or Munmap could race a blocked futex wait.
+		futexWake(sm.u32Addr(pr.rxCbOffset + offsetWPktWr))
+		futexWake(sm.u32Addr(pr.txCbOffset + offsetRPktRe))
+		sm.wakeReaders(i)
+		sm.wakeWriters(i)
 	}
+	for atomic.LoadInt32(&sm.inflight) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func (sm *Shmx) canBlockRead() bool {
+	return sm.blockingR && sm.peerReady() && atomic.LoadInt32(&sm.closed) == 0
+}
 
-	// Do we need to wrap?
-	var m int
-	if sm.rx.RIndex+length > sm.rxRIndexWrap {
-		m = copy(b, sm.m[sm.rxOffsetBase+sm.rx.RIndex:sm.rxOffsetWrap])
-		sm.rx.RIndex = 0
+func (sm *Shmx) canBlockWrite() bool {
+	return sm.blockingW && sm.peerReady() && atomic.LoadInt32(&sm.closed) == 0
+}
+
+// peerReady reports whether the peer supports the wake side of the
+// blocking protocol: a Slave trusts its cached shmxFlagBlocking from
+// attach time, while a Master reads the live shmxFlagSlaveBlocking bit,
+// since no Slave may exist yet when it attaches.
+func (sm *Shmx) peerReady() bool {
+	if sm.role == Slave {
+		return sm.peerBlocking
 	}
+	return atomic.LoadUint32(sm.u32Addr(offsetConfigFlags))&shmxFlagSlaveBlocking != 0
+}
 
-	i := sm.rxOffsetBase + sm.rx.RIndex
-	j := i + length - uint32(m)
-	n = copy(b[m:], sm.m[i:j])
-	if m+n != int(length) {
-		panic(fmt.Errorf("m %d + n %d != length %d", m, n, length))
+func (sm *Shmx) u32Addr(off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&sm.m[off]))
+}
+
+// setFlag atomically ORs bit into the shared Flags word, for capabilities
+// not known until a peer actually attaches.
+func (sm *Shmx) setFlag(bit uint32) {
+	addr := sm.u32Addr(offsetConfigFlags)
+	for {
+		old := atomic.LoadUint32(addr)
+		if old&bit != 0 {
+			return
+		}
+		if atomic.CompareAndSwapUint32(addr, old, old|bit) {
+			return
+		}
+	}
+}
+
+// waitForData blocks until ring pair i's peer advances WPktWrote, the read
+// deadline elapses, or Close is called.
+func (sm *Shmx) waitForData(i int) error {
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return io.EOF
 	}
 
-	sm.rx.RIndex += uint32(round32(n))
-	if sm.rx.RIndex >= sm.rxRIndexWrap {
-		sm.rx.RIndex = 0
+	pr := &sm.pairs[i]
+
+	ts, expired := sm.deadlineTimespec(sm.rdDeadline)
+	if expired {
+		return errTimeout
 	}
-	sm.rx.RPktRead++
-	sm.putRxCB()
 
-	n += m
+	waiters := sm.u32Addr(pr.rxCbOffset + offsetRWaiters)
+	atomic.AddUint32(waiters, 1)
+	werr := futexWait(sm.u32Addr(pr.rxCbOffset+offsetWPktWr), pr.rx.WPktWrote, ts)
+	atomic.AddUint32(waiters, ^uint32(0))
 
-	return n, nil
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return io.EOF
+	}
+	return werr
 }
 
-func (sm *Shmx) getUint32() (u uint32) {
-	i := int(sm.rxOffsetBase + sm.rx.RIndex)
-	u = binary.LittleEndian.Uint32(sm.m[i:])
-	sm.rx.RIndex += 4
-	if sm.rx.RIndex == sm.rxRIndexWrap {
-		sm.rx.RIndex = 0
+// waitForSpace blocks until ring pair i's peer advances RPktRead, the write
+// deadline elapses, or Close is called.
+func (sm *Shmx) waitForSpace(i int) error {
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return io.EOF
 	}
-	return u
+
+	pr := &sm.pairs[i]
+
+	ts, expired := sm.deadlineTimespec(sm.wrDeadline)
+	if expired {
+		return errTimeout
+	}
+
+	waiters := sm.u32Addr(pr.txCbOffset + offsetWWaiters)
+	atomic.AddUint32(waiters, 1)
+	werr := futexWait(sm.u32Addr(pr.txCbOffset+offsetRPktRe), pr.tx.RPktRead, ts)
+	atomic.AddUint32(waiters, ^uint32(0))
+
+	if atomic.LoadInt32(&sm.closed) != 0 {
+		return io.EOF
+	}
+	return werr
 }
 
-func (sm *Shmx) getConstSize() {
-	sm.rx.ConstSize = binary.LittleEndian.Uint32(sm.m[sm.rxCbOffset+offsetConstS:])
-	sm.tx.ConstSize = binary.LittleEndian.Uint32(sm.m[sm.txCbOffset+offsetConstS:])
+// wakeReaders wakes any Read blocked on ring pair i waiting for this
+// Write's data, if the waiters count says anyone is listening.
+func (sm *Shmx) wakeReaders(i int) {
+	pr := &sm.pairs[i]
+	if atomic.LoadUint32(sm.u32Addr(pr.txCbOffset+offsetRWaiters)) == 0 {
+		return
+	}
+	futexWake(sm.u32Addr(pr.txCbOffset + offsetWPktWr))
 }
 
-func (sm *Shmx) refreshRxCB() {
-	sm.rx.WIndex = binary.LittleEndian.Uint32(sm.m[sm.rxCbOffset+offsetWIndex:])
-	sm.rx.WPktWrote = binary.LittleEndian.Uint32(sm.m[sm.rxCbOffset+offsetWPktWr:])
-	sm.rx.WPktLost = binary.LittleEndian.Uint32(sm.m[sm.rxCbOffset+offsetWPktLo:])
+// wakeWriters wakes any Write blocked on ring pair i waiting for this
+// Read's freed space, if the waiters count says anyone is listening.
+func (sm *Shmx) wakeWriters(i int) {
+	pr := &sm.pairs[i]
+	if atomic.LoadUint32(sm.u32Addr(pr.rxCbOffset+offsetWWaiters)) == 0 {
+		return
+	}
+	futexWake(sm.u32Addr(pr.rxCbOffset + offsetRPktRe))
 }
 
-func (sm *Shmx) putRxCB() {
-	binary.LittleEndian.PutUint32(sm.m[sm.rxCbOffset+offsetRIndex:], sm.rx.RIndex)
-	binary.LittleEndian.PutUint32(sm.m[sm.rxCbOffset+offsetRPktRe:], sm.rx.RPktRead)
+// deadlineTimespec converts deadline into a relative unix.Timespec for
+// FUTEX_WAIT. A zero deadline means block forever (nil timeout). A
+// deadline already in the past reports expired=true.
+func (sm *Shmx) deadlineTimespec(deadline time.Time) (ts *unix.Timespec, expired bool) {
+	if deadline.IsZero() {
+		return nil, false
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil, true
+	}
+	t := unix.NsecToTimespec(remaining.Nanoseconds())
+	return &t, false
 }
 
-func (sm *Shmx) refreshTxCB() {
-	sm.tx.RIndex = binary.LittleEndian.Uint32(sm.m[sm.txCbOffset+offsetRIndex:])
-	sm.tx.RPktRead = binary.LittleEndian.Uint32(sm.m[sm.txCbOffset+offsetRPktRe:])
+// Linux futex(2) operations. x/sys/unix has no Futex wrapper, so these
+// are issued directly via the raw syscall, the same way x/sys/unix
+// itself implements thin syscall wrappers.
+const (
+	futexWaitOp = 0
+	futexWakeOp = 1
+)
+
+// futexWait sleeps while *addr == expect, up to timeout (nil means
+// forever). It relies on FUTEX_WAIT's cross-process behavior on a
+// MAP_SHARED mapping rather than FUTEX_PRIVATE_FLAG.
+func futexWait(addr *uint32, expect uint32, timeout *unix.Timespec) error {
+	_, _, errno := unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWaitOp,
+		uintptr(expect), uintptr(unsafe.Pointer(timeout)), 0, 0)
+	switch errno {
+	case 0, unix.EAGAIN, unix.EINTR:
+		return nil
+	case unix.ETIMEDOUT:
+		return errTimeout
+	}
+	return errno
 }
 
-func (sm *Shmx) putTxCB() {
-	binary.LittleEndian.PutUint32(sm.m[sm.txCbOffset+offsetWIndex:], sm.tx.WIndex)
-	binary.LittleEndian.PutUint32(sm.m[sm.txCbOffset+offsetWPktWr:], sm.tx.WPktWrote)
-	binary.LittleEndian.PutUint32(sm.m[sm.txCbOffset+offsetWPktLo:], sm.tx.WPktLost)
+// futexWake wakes every waiter blocked on addr.
+func futexWake(addr *uint32) {
+	unix.Syscall6(unix.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWakeOp, 1<<30, 0, 0, 0)
 }